@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core"
@@ -70,11 +71,12 @@ func main() {
 	}
 
 	message := types.NewMessage(from, tx.To(), 0, tx.Value(), tx.Gas(),
-		tx.GasPrice(), tx.Data(), false)
+		tx.GasPrice(), tx.GasFeeCap(), tx.GasTipCap(), tx.Data(), tx.AccessList(), false)
 
 	author := block.Coinbase()
 
-	vmCtx := core.NewEVMContext(message, block.Header(), &Chain{}, &author)
+	blockCtx := core.NewEVMBlockContext(block.Header(), &Chain{}, &author)
+	txCtx := core.NewEVMTxContext(message)
 
 	contracts, err := Contracts()
 	if err != nil {
@@ -82,9 +84,9 @@ func main() {
 	}
 
 	tracer := NewTracer(contracts)
-	vmConfig := vm.Config{Debug: true, Tracer: tracer}
+	vmConfig := vm.Config{Tracer: tracer}
 
-	env := vm.NewEVM(vmCtx, stateDB, chainCfg, vmConfig)
+	env := vm.NewEVM(blockCtx, txCtx, stateDB, chainCfg, vmConfig)
 	_, _, err = env.Call(vm.AccountRef(from), *tx.To(), tx.Data(), tx.Gas(), tx.Value())
 	if err != nil {
 		log.Fatalf("failed calling contract: %s", err)
@@ -97,5 +99,27 @@ func main() {
 		contract := contracts[frame.Contract]
 
 		log.Printf("%s:%d%s%s", contract.Name, frame.Line, strings.Repeat("\t", int(frame.Depth+2)), frame.Source)
+
+		if frame.RevertReason != "" {
+			log.Printf("%s:%d%srevert %s", contract.Name, frame.Line, strings.Repeat("\t", int(frame.Depth+2)), frame.RevertReason)
+		}
+	}
+
+	trace := tracer.ToCallTracer()
+	traceJSON, err := json.MarshalIndent(trace, "", "  ")
+	if err != nil {
+		log.Fatalf("failed marshalling call trace: %s", err)
+	}
+
+	fmt.Println(string(traceJSON))
+
+	lines, byOp := tracer.GasReport()
+	fmt.Println("--- gas report ---")
+	for _, line := range lines {
+		contract := contracts[line.Contract]
+		fmt.Printf("%s:%d\tgas=%d\tcount=%d\n", contract.Name, line.Line, line.Gas, line.Count)
+	}
+	for op, gas := range byOp {
+		fmt.Printf("%s\tgas=%d\n", op, gas)
 	}
 }
@@ -27,11 +27,12 @@ func ExampleRunning() {
 	}
 
 	message := types.NewMessage(from, tx.To(), 0, tx.Value(), tx.Gas(),
-		tx.GasPrice(), tx.Data(), false)
+		tx.GasPrice(), tx.GasFeeCap(), tx.GasTipCap(), tx.Data(), tx.AccessList(), false)
 
 	author := block.Coinbase()
 
-	vmCtx := core.NewEVMContext(message, block.Header(), &Chain{}, &author)
+	blockCtx := core.NewEVMBlockContext(block.Header(), &Chain{}, &author)
+	txCtx := core.NewEVMTxContext(message)
 
 	contracts, err := Contracts()
 	if err != nil {
@@ -39,9 +40,9 @@ func ExampleRunning() {
 	}
 
 	tracer := NewTracer(contracts)
-	vmConfig := vm.Config{Debug: true, Tracer: tracer}
+	vmConfig := vm.Config{Tracer: tracer}
 
-	env := vm.NewEVM(vmCtx, stateDB, chainCfg, vmConfig)
+	env := vm.NewEVM(blockCtx, txCtx, stateDB, chainCfg, vmConfig)
 	_, _, err = env.Call(vm.AccountRef(from), *tx.To(), tx.Data(), tx.Gas(), tx.Value())
 	if err != nil {
 		log.Fatalf("failed calling contract: %s", err)
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/tracers"
 	"log"
 	"math/big"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
 var InvalidOpcode vm.OpCode = 0xfe
@@ -24,7 +30,67 @@ type CallFrame struct {
 
 	Depth uint64 `json:"level"`
 
+	// callDepth is the pure message-call nesting depth (t.depth at
+	// CaptureEnter time, with no jumpDepth mixed in), set only on frames that
+	// correspond to a real CALL/CREATE. ToCallTracer builds its nested tree
+	// from this instead of Depth, which also counts internal JUMPs and would
+	// otherwise attach children to the wrong parent.
+	callDepth uint64
+
 	Params []string `json:"params"`
+
+	// Fields below mirror go-ethereum's callTracer ("debug_traceTransaction")
+	// output shape, so a trace can be fed straight into tooling built around
+	// that RPC. They're only populated for frames that correspond to a real
+	// EVM message call (CALL/CALLCODE/STATICCALL/DELEGATECALL/CREATE/CREATE2);
+	// internal (JUMP-based) and event (LOG) frames leave Type set to
+	// "INTERNAL"/"EVENT" respectively and are omitted from ToCallTracer's tree.
+	Type    string       `json:"type,omitempty"`
+	From    string       `json:"from,omitempty"`
+	To      string       `json:"to,omitempty"`
+	Input   string       `json:"input,omitempty"`
+	Output  string       `json:"output,omitempty"`
+	Gas     string       `json:"gas,omitempty"`
+	GasUsed string       `json:"gasUsed,omitempty"`
+	Value   string       `json:"value,omitempty"`
+	Calls   []*CallFrame `json:"calls,omitempty"`
+
+	// EventName is set when Type is "EVENT": this frame represents a decoded
+	// `emit Event(...)` rather than a call or jump, and Params holds its
+	// decoded indexed/non-indexed arguments.
+	EventName string `json:"event,omitempty"`
+
+	// RevertReason/RevertArgs are set on the single frame executing a REVERT:
+	// RevertReason is either a standard Error(string) message or a
+	// "CustomError(args...)" rendering, and RevertArgs holds the latter's
+	// decoded arguments.
+	RevertReason string   `json:"revertReason,omitempty"`
+	RevertArgs   []string `json:"revertArgs,omitempty"`
+
+	// GasStart/GasEnd are the gas remaining immediately before/after the
+	// opcode (or, for CALL/CREATE frames, the whole subcall) this frame
+	// represents; GasCost is their difference, kept separately for
+	// readability and because GasEnd can't go below zero to derive it from.
+	GasStart uint64 `json:"gasStart,omitempty"`
+	GasEnd   uint64 `json:"gasEnd,omitempty"`
+	GasCost  uint64 `json:"gasCost,omitempty"`
+}
+
+// lineKey identifies a source line within a specific contract, so gas can be
+// aggregated per-(contract, line) pair across a trace that touches several
+// contracts.
+type lineKey struct {
+	Contract string
+	Line     int
+}
+
+// LineGas is one row of a Tracer.GasReport(): the total gas spent executing
+// a source line, and how many opcodes contributed to it.
+type LineGas struct {
+	Contract string `json:"contract"`
+	Line     int    `json:"line"`
+	Gas      uint64 `json:"gas"`
+	Count    uint64 `json:"count"`
 }
 
 type CallStack []*CallFrame
@@ -69,8 +135,21 @@ type Tracer struct {
 	sourceMaps      map[string][]*SourceMapping
 	receivers       map[string][]string
 	functionDefs    map[string][]*AstNode
+	eventDefs       map[string][]*AstNode
+	errorDefs       map[string][]*AstNode
+
+	gasByLine map[lineKey]*LineGas
+	gasByOp   map[vm.OpCode]uint64
+
+	// callStack is the real LIFO stack of in-flight message-call frames
+	// (pushed by CaptureStart/CaptureEnter, popped by CaptureExit/CaptureEnd),
+	// kept separate from Stack because Stack is an append-only flat log of
+	// every frame (calls, INTERNAL jumps, EVENT logs) that's never popped.
+	callStack CallStack
 
-	jumpDepth int64
+	depth      int
+	jumpDepth  int64
+	stopReason error
 }
 
 func NewTracer(contracts map[string]*TruffleContract) *Tracer {
@@ -81,84 +160,232 @@ func NewTracer(contracts map[string]*TruffleContract) *Tracer {
 		sourceMaps:      make(map[string][]*SourceMapping),
 		receivers:       make(map[string][]string),
 		functionDefs:    make(map[string][]*AstNode),
+		eventDefs:       make(map[string][]*AstNode),
+		errorDefs:       make(map[string][]*AstNode),
+
+		gasByLine: make(map[lineKey]*LineGas),
+		gasByOp:   make(map[vm.OpCode]uint64),
 	}
 
 	for addr, contract := range contracts {
 		t.sourceMaps[addr] = ParseSourceMap(contract.SourceMap, contract.SourceCode)
 		t.receivers[addr] = DiscoverReceivers(contract.Ast)
 		t.functionDefs[addr] = DiscoverPrivateFunctionDefinitions(contract.Ast)
+		t.eventDefs[addr] = DiscoverEventDefinitions(contract.Ast)
+		t.errorDefs[addr] = DiscoverErrorDefinitions(contract.Ast)
 	}
 
 	return t
 }
 
-func (t *Tracer) CaptureStart(from common.Address, to common.Address, call bool, input []byte, gas uint64, value *big.Int) error {
+// CaptureStart, CaptureEnd, CaptureEnter, CaptureExit, CaptureState and
+// CaptureFault implement the current go-ethereum vm.EVMLogger interface, so
+// *Tracer can be driven directly by vm.Config{Tracer: ...} on a live EVM
+// (see newSourceTracer) instead of only through the standalone CLI in main.go.
+
+func (t *Tracer) CaptureTxStart(gasLimit uint64) {}
+
+func (t *Tracer) CaptureTxEnd(restGas uint64) {}
+
+func (t *Tracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
 	contract, ok := t.contracts[strings.ToLower(to.String())]
 	if !ok {
-		return nil
+		return
 	}
 
 	fnDefs := DiscoverFunctionDefinitions(contract.Ast)
 
 	target := fmt.Sprintf("%x", input[:4])
-	//log.Printf("Start: from %s, to %s, call %t, input 0x%x, gas %d, value %d", from.String(), strings.ToLower(to.String()), call, input, gas, value)
+	//log.Printf("Start: from %s, to %s, create %t, input 0x%x, gas %d, value %d", from.String(), strings.ToLower(to.String()), create, input, gas, value)
 	for _, fnDef := range fnDefs {
 		ref := fnDef.Receiver()
 		if ref != target {
 			continue
 		}
 
-		parts := strings.Split(fnDef.Source, ":")
-		if len(parts) < 2 {
-			panic("No parts")
-		}
+		source, line := t.fnDefSource(contract, fnDef)
+		params := DecodeParams(fnDef.Parameters.Parameters, input[4:])
 
-		start, err := strconv.Atoi(parts[0])
-		if err != nil {
-			panic(err)
+		frame := &CallFrame{
+			Contract:    strings.ToLower(to.String()),
+			Instruction: 0,
+			Source:      source,
+			Depth:       0,
+			Line:        line,
+			Params:      params,
+
+			Type:  "CALL",
+			From:  from.String(),
+			To:    strings.ToLower(to.String()),
+			Input: fmt.Sprintf("0x%x", input),
+			Gas:   fmt.Sprintf("0x%x", gas),
+			Value: fmt.Sprintf("0x%x", value),
 		}
-		length, err := strconv.Atoi(parts[1])
 
-		i := 0
-		l := 1
-		c := 1
+		t.Stack.Push(frame)
+		t.callStack.Push(frame)
+	}
+}
 
-		for i < start {
-			if contract.SourceCode[i] == '\n' {
-				l++
-				c = 0
-			}
+// fnDefSource resolves a function definition's AST source range to its
+// first line of text and 1-indexed line number within contract.SourceCode.
+func (t *Tracer) fnDefSource(contract *TruffleContract, fnDef *AstNode) (string, int) {
+	parts := strings.Split(fnDef.Source, ":")
+	if len(parts) < 2 {
+		panic("No parts")
+	}
+
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		panic(err)
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil {
+		panic(err)
+	}
 
-			c++
-			i++
+	i := 0
+	l := 1
+
+	for i < start {
+		if contract.SourceCode[i] == '\n' {
+			l++
 		}
 
-		var params []string
-		offset := 4
-		for _, param := range fnDef.Parameters.Parameters {
-			p, o := DecodeParam(param, offset, input)
-			offset += o
-			if p == "" {
-				continue
-			}
+		i++
+	}
+
+	return strings.Split(contract.SourceCode[start:start+length], "\n")[0], l
+}
+
+// CaptureEnter fires on every real EVM message call (CALL/CALLCODE/
+// STATICCALL/DELEGATECALL/CREATE/CREATE2), replacing the manual stack/memory
+// decoding the legacy CaptureState switch used to do for those opcodes.
+func (t *Tracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	t.depth++
+
+	var frame *CallFrame
+	if typ == vm.CREATE || typ == vm.CREATE2 {
+		frame = t.captureCreate(to, input)
+	} else {
+		frame = t.captureCall(to, input)
+	}
+
+	frame.Depth = uint64(t.depth) + uint64(t.jumpDepth)
+	frame.callDepth = uint64(t.depth)
+	frame.Type = typ.String()
+	frame.From = strings.ToLower(from.String())
+	frame.To = strings.ToLower(to.String())
+	frame.Input = fmt.Sprintf("0x%x", input)
+	frame.Gas = fmt.Sprintf("0x%x", gas)
+	frame.GasStart = gas
+
+	if typ == vm.CALL || typ == vm.CALLCODE {
+		frame.Value = fmt.Sprintf("0x%x", value)
+	}
 
-			params = append(params, p)
+	t.Stack.Push(frame)
+	t.callStack.Push(frame)
+}
+
+// captureCall builds the frame for a CALL/CALLCODE/STATICCALL/DELEGATECALL,
+// decoding the called function and its parameters from the 4-byte selector
+// prefixing input.
+func (t *Tracer) captureCall(to common.Address, input []byte) *CallFrame {
+	var receiver []byte
+	if len(input) >= 4 {
+		receiver = input[:4]
+	}
+
+	fnDef := t.findFnDef(to.String(), receiver)
+	if fnDef == nil {
+		return &CallFrame{Contract: strings.ToLower(to.String())}
+	}
+
+	frame := &CallFrame{
+		Contract: strings.ToLower(to.String()),
+		Params:   DecodeParams(fnDef.Parameters.Parameters, input[4:]),
+	}
+
+	if contract, ok := t.contracts[strings.ToLower(to.String())]; ok {
+		frame.Source, frame.Line = t.fnDefSource(contract, fnDef)
+	}
+
+	return frame
+}
+
+// captureCreate builds the frame for a CREATE/CREATE2, matching the init
+// code against the known contracts' deployment bytecode (TruffleContract.Bytecode,
+// not DeployedBytecode, since the EVM is still running the constructor) so we
+// can label the frame with the constructor source and decode its arguments,
+// which are ABI-encoded and appended directly after the deployment bytecode.
+// The deployed address is whatever go-ethereum already computed and passed
+// as "to" to CaptureEnter, so it's registered against the matched contract
+// for any subsequent calls into it within the same trace.
+func (t *Tracer) captureCreate(to common.Address, input []byte) *CallFrame {
+	addr := strings.ToLower(to.String())
+
+	contract, ctorInput := t.matchInitCode(input)
+	if contract == nil {
+		return &CallFrame{Contract: addr}
+	}
+
+	t.contracts[addr] = contract
+	t.sourceMaps[addr] = ParseSourceMap(contract.SourceMap, contract.SourceCode)
+	t.receivers[addr] = DiscoverReceivers(contract.Ast)
+	t.functionDefs[addr] = DiscoverPrivateFunctionDefinitions(contract.Ast)
+	t.eventDefs[addr] = DiscoverEventDefinitions(contract.Ast)
+	t.errorDefs[addr] = DiscoverErrorDefinitions(contract.Ast)
+
+	frame := &CallFrame{Contract: addr}
+
+	ctor := DiscoverConstructorDefinition(contract.Ast)
+	if ctor == nil {
+		return frame
+	}
+
+	frame.Params = DecodeParams(ctor.Parameters.Parameters, ctorInput)
+	frame.Source, frame.Line = t.fnDefSource(contract, ctor)
+
+	return frame
+}
+
+// matchInitCode finds the known TruffleContract whose deployment bytecode is
+// a prefix of input, and returns the trailing bytes (the ABI-encoded
+// constructor arguments appended by solc/truffle after the bytecode).
+func (t *Tracer) matchInitCode(input []byte) (*TruffleContract, []byte) {
+	for _, contract := range t.contracts {
+		bytecode := common.FromHex(contract.Bytecode)
+		if len(bytecode) == 0 || len(input) < len(bytecode) {
+			continue
 		}
 
-		t.Stack.Push(&CallFrame{
-			Contract:    strings.ToLower(to.String()),
-			Instruction: 0,
-			Source:      strings.Split(contract.SourceCode[start:start+length], "\n")[0],
-			Depth:       0,
-			Line:        l,
-			Params:      params,
-		})
+		if bytes.Equal(input[:len(bytecode)], bytecode) {
+			return contract, input[len(bytecode):]
+		}
 	}
 
-	return nil
+	return nil, nil
 }
 
-func (t *Tracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+func (t *Tracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	t.depth--
+
+	frame := t.callStack.Peek()
+	if frame == nil {
+		return
+	}
+	t.callStack.Pop()
+
+	frame.Output = fmt.Sprintf("0x%x", output)
+	frame.GasUsed = fmt.Sprintf("0x%x", gasUsed)
+	frame.GasCost = gasUsed
+	if gasUsed <= frame.GasStart {
+		frame.GasEnd = frame.GasStart - gasUsed
+	}
+}
+
+func (t *Tracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
 	defer func() {
 		if op == vm.JUMP || op == vm.JUMPI {
 			return
@@ -166,73 +393,13 @@ func (t *Tracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost ui
 
 		t.LastJump = nil
 	}()
-	//log.Printf("PC %d %s // %s\n", pc, op.String(), strings.ToLower(contract.Address().String()))
-	switch op {
-	case vm.CALL, vm.CALLCODE:
-		addr := stack.Back(1)
-		data := memory.Get(stack.Back(3).Int64(), stack.Back(4).Int64())
-		receiver := data[:4]
-
-		fnDef := t.findFnDef(common.BigToAddress(addr).String(), receiver)
-
-		var params []string
-		offset := 4
-		for _, param := range fnDef.Parameters.Parameters {
-			p, o := DecodeParam(param, offset, data)
-			offset += o
-			if p == "" {
-				continue
-			}
-
-			params = append(params, p)
-		}
 
-		//t.jumpDepth++
-		//newAddr := common.BigToAddress(stack.Back(1))
-		t.Stack.Push(&CallFrame{
-			Contract:    strings.ToLower(contract.Address().String()),
-			Instruction: t.toInstruction(contract, pc),
-			//Depth:       uint64(t.jumpDepth),
-			Depth:  uint64(depth) + uint64(t.jumpDepth),
-			Source: t.toPreviousSource(contract, pc),
-			Line:   t.toLine(t.toPreviousSourceMapping(contract, t.toInstruction(contract, pc))),
-
-			Params: params,
-			//PC: pc,
-		})
-
-	case vm.STATICCALL, vm.DELEGATECALL:
-		addr := stack.Back(1)
-		data := memory.Get(stack.Back(3).Int64(), stack.Back(4).Int64())
-		receiver := data[:4]
-
-		fnDef := t.findFnDef(common.BigToAddress(addr).String(), receiver)
-
-		var params []string
-		offset := 4
-		for _, param := range fnDef.Parameters.Parameters {
-			p, o := DecodeParam(param, offset, data)
-			offset += o
-			if p == "" {
-				continue
-			}
+	contract, stack := scope.Contract, scope.Stack
 
-			params = append(params, p)
-		}
+	t.recordGas(contract, pc, op, cost)
 
-		//t.jumpDepth++
-		//newAddr := common.BigToAddress(stack.Back(1))
-		t.Stack.Push(&CallFrame{
-			Contract:    strings.ToLower(contract.Address().String()),
-			Instruction: t.toInstruction(contract, pc),
-			//Depth:       uint64(t.jumpDepth),
-			Depth:  uint64(depth) + uint64(t.jumpDepth),
-			Source: t.toPreviousSource(contract, pc),
-			Line:   t.toLine(t.toPreviousSourceMapping(contract, t.toInstruction(contract, pc))),
-
-			Params: params,
-			//PC: pc,
-		})
+	//log.Printf("PC %d %s // %s\n", pc, op.String(), strings.ToLower(contract.Address().String()))
+	switch op {
 	case vm.JUMP:
 		//fmt.Printf("PC %d %s // %s\n", pc, op.String(), strings.ToLower(contract.Address().String()))
 		//fmt.Printf("JUMP TO: %s\n", common.BigToHash(stack.Back(0)).String())
@@ -245,9 +412,13 @@ func (t *Tracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost ui
 			Line:   t.toLine(t.toSourceMapping(contract, t.toInstruction(contract, pc))),
 
 			PC: pc,
+
+			GasStart: gas,
+			GasEnd:   gas - cost,
+			GasCost:  cost,
 		}
 
-		return nil
+		return
 	case vm.JUMPDEST:
 		if t.Stack.Lookup(pc - 1) {
 			t.jumpDepth--
@@ -257,18 +428,18 @@ func (t *Tracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost ui
 				t.jumpDepth = 0
 			}
 
-			return nil
+			return
 		}
 
 		i := t.toInstruction(contract, pc)
 		srcMapping := t.toSourceMapping(contract, i)
 		if srcMapping == nil {
-			return nil
+			return
 		}
 
 		if fnDef := t.isFunctionDefinition(contract, srcMapping); fnDef != nil && t.LastJump != nil {
 			if ok, err := regexp.MatchString(`(?m)function(.*\s)+}`, t.LastJump.Source); ok || err != nil {
-				return nil
+				return
 			}
 
 			paramNodes := fnDef.Parameters.Parameters
@@ -287,29 +458,325 @@ func (t *Tracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost ui
 			}
 
 			t.LastJump.Params = params
+			t.LastJump.Type = "INTERNAL"
 
 			t.Stack.Push(t.LastJump)
 			t.jumpDepth++
 			//fmt.Printf("JUMPDEST %d %d %d:%d\n", pc, i, srcMapping.Start, srcMapping.Length)
 		}
-	case vm.RETURN, vm.REVERT, vm.STOP, vm.SELFDESTRUCT, InvalidOpcode:
+	case vm.LOG0, vm.LOG1, vm.LOG2, vm.LOG3, vm.LOG4:
+		t.captureLog(op, contract, stack, scope.Memory, depth, gas, cost)
+	case vm.REVERT:
+		offset, size := stack.Back(0).Int64(), stack.Back(1).Int64()
+		data := scope.Memory.Get(offset, size)
+
+		addr := strings.ToLower(contract.Address().String())
+		reason, args := t.decodeRevert(addr, data)
+
+		// Attach once, to the frame executing the REVERT: it's popped by the
+		// CaptureExit that follows immediately, so it never gets re-stamped
+		// as the call stack unwinds further.
+		if frame := t.callStack.Peek(); frame != nil {
+			frame.RevertReason, frame.RevertArgs = reason, args
+		}
+	case vm.RETURN, vm.STOP, vm.SELFDESTRUCT, InvalidOpcode:
 		//t.jumpDepth--
 	}
+}
 
-	return nil
+// recordGas accumulates cost (the gas spent executing this single opcode)
+// against the source line it maps to and against its opcode, so a full
+// trace builds up a per-line/per-opcode gas hotspot profile. Opcodes that
+// don't map to a known source line (e.g. untracked contracts) are still
+// counted against gasByOp but skipped for gasByLine.
+//
+// CALL/CALLCODE/STATICCALL/DELEGATECALL/CREATE/CREATE2 are skipped entirely:
+// the cost the EVM reports for them includes the gas forwarded to the
+// callee, and that gas is recorded again as the callee's own opcodes
+// execute, so counting it here too would double-count every sub-call.
+func (t *Tracer) recordGas(contract *vm.Contract, pc uint64, op vm.OpCode, cost uint64) {
+	if isCallOrCreate(op) {
+		return
+	}
+
+	t.gasByOp[op] += cost
+
+	addr := strings.ToLower(contract.Address().String())
+	mapping := t.toSourceMapping(contract, t.toInstruction(contract, pc))
+	if mapping == nil {
+		return
+	}
+
+	key := lineKey{Contract: addr, Line: mapping.Line}
+	line, ok := t.gasByLine[key]
+	if !ok {
+		line = &LineGas{Contract: addr, Line: mapping.Line}
+		t.gasByLine[key] = line
+	}
+
+	line.Gas += cost
+	line.Count++
 }
 
-func (*Tracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
-	log.Printf("Fault: PC %d %s // %s", pc, op.String(), strings.ToLower(contract.Address().String()))
-	log.Printf("Error depth %d, %s", depth, err)
+// isCallOrCreate reports whether op is one of the message-call/contract-
+// creation opcodes whose reported cost includes gas forwarded to a callee.
+func isCallOrCreate(op vm.OpCode) bool {
+	switch op {
+	case vm.CALL, vm.CALLCODE, vm.STATICCALL, vm.DELEGATECALL, vm.CREATE, vm.CREATE2:
+		return true
+	default:
+		return false
+	}
+}
+
+// captureLog decodes a LOG0-LOG4 into an "emit Event(...)" frame: the topic
+// count comes from the opcode itself, topic0 (if any) is matched against the
+// keccak256 of the contract's known event signatures, and the remaining
+// topics/data are decoded as the event's indexed/non-indexed arguments.
+// Anonymous logs (LOG0, or any topic0 we don't recognise) are dropped since
+// there's no event definition to decode them against.
+func (t *Tracer) captureLog(op vm.OpCode, contract *vm.Contract, stack *vm.Stack, memory *vm.Memory, depth int, gas, cost uint64) {
+	topicCount := int(op - vm.LOG0)
+	if topicCount == 0 {
+		return
+	}
+
+	offset, size := stack.Back(0).Int64(), stack.Back(1).Int64()
+	data := memory.Get(offset, size)
+
+	topic0 := common.BigToHash(stack.Back(2))
+
+	addr := strings.ToLower(contract.Address().String())
+	eventDef := t.findEventDef(addr, topic0)
+	if eventDef == nil {
+		return
+	}
+
+	var topics []common.Hash
+	for i := 1; i < topicCount; i++ {
+		topics = append(topics, common.BigToHash(stack.Back(2+i)))
+	}
+
+	args := DecodeEventArgs(eventDef, topics, data)
+
+	t.Stack.Push(&CallFrame{
+		Contract:  addr,
+		Depth:     uint64(depth) + uint64(t.jumpDepth),
+		Source:    "emit " + eventDef.Name + "(" + strings.Join(args, ", ") + ")",
+		Type:      "EVENT",
+		EventName: eventDef.Name,
+		Params:    args,
+
+		GasStart: gas,
+		GasEnd:   gas - cost,
+		GasCost:  cost,
+	})
+}
+
+// revertStringSelector is the 4-byte selector of Solidity's standard
+// Error(string) revert, used for plain `require`/`revert("...")` reverts.
+var revertStringSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+
+// decodeRevert decodes a REVERT's returndata as either a standard
+// Error(string) message or a custom error matched by selector against addr's
+// known ErrorDefinitions, rendering the latter as "Name(args...)".
+func (t *Tracer) decodeRevert(addr string, data []byte) (string, []string) {
+	if len(data) < 4 {
+		return "", nil
+	}
+
+	selector, payload := data[:4], data[4:]
+
+	if bytes.Equal(selector, revertStringSelector) {
+		stringTy, _ := abi.NewType("string", "", nil)
+		values, err := (abi.Arguments{{Type: stringTy}}).UnpackValues(payload)
+		if err != nil || len(values) == 0 {
+			return "", nil
+		}
+
+		return fmt.Sprintf("%v", values[0]), nil
+	}
+
+	errDef := t.findErrorDef(addr, selector)
+	if errDef == nil {
+		return "", nil
+	}
+
+	args := DecodeParams(errDef.Parameters.Parameters, payload)
+	return errDef.Name + "(" + strings.Join(args, ", ") + ")", args
+}
+
+// findErrorDef looks up a contract's ErrorDefinition by matching its
+// canonical signature's 4-byte selector (the same keccak256-derived selector
+// a custom error reverts with) against selector.
+func (t *Tracer) findErrorDef(addr string, selector []byte) *AstNode {
+	for _, errDef := range t.errorDefs[addr] {
+		if bytes.Equal(crypto.Keccak256([]byte(errorSignature(errDef)))[:4], selector) {
+			return errDef
+		}
+	}
+
 	return nil
 }
 
-func (*Tracer) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
-	//log.Printf("End: Output %x, Gas Used %d, Time %s, Err %s", output, gasUsed, t, err)
+// errorSignature builds the canonical "Name(type,type,...)" signature a
+// custom error's revert selector is the keccak256 hash of.
+func errorSignature(errDef *AstNode) string {
+	types := make([]string, len(errDef.Parameters.Parameters))
+	for i, param := range errDef.Parameters.Parameters {
+		types[i] = canonicalEventParamType(param.TypeDescriptions.TypeString)
+	}
+
+	return errDef.Name + "(" + strings.Join(types, ",") + ")"
+}
+
+// findEventDef looks up a contract's EventDefinition by matching topic0
+// against the keccak256 hash of each known event's canonical signature.
+func (t *Tracer) findEventDef(addr string, topic0 common.Hash) *AstNode {
+	for _, eventDef := range t.eventDefs[addr] {
+		if crypto.Keccak256Hash([]byte(eventSignature(eventDef))) == topic0 {
+			return eventDef
+		}
+	}
+
 	return nil
 }
 
+// eventSignature builds the canonical "Name(type,type,...)" signature an
+// event's topic0 is the keccak256 hash of.
+func eventSignature(eventDef *AstNode) string {
+	types := make([]string, len(eventDef.Parameters.Parameters))
+	for i, param := range eventDef.Parameters.Parameters {
+		types[i] = canonicalEventParamType(param.TypeDescriptions.TypeString)
+	}
+
+	return eventDef.Name + "(" + strings.Join(types, ",") + ")"
+}
+
+// canonicalEventParamType mirrors abiType's prefix handling for the subset
+// of cases that don't need an abi.Type: structs fall back to their raw
+// typeString, since the canonical tuple signature would need component
+// metadata this AST wrapper doesn't expose. The array suffix (if any) is
+// stripped before matching and re-appended after, so "enum Foo[]"/
+// "contract Bar[3]" normalize to "uint8[]"/"address[3]" instead of losing
+// their array-ness.
+func canonicalEventParamType(typeString string) string {
+	suffix := ""
+	if loc := arraySuffixRe.FindStringIndex(typeString); loc != nil {
+		suffix, typeString = typeString[loc[0]:], typeString[:loc[0]]
+	}
+
+	switch {
+	case enumTypeRe.MatchString(typeString):
+		return "uint8" + suffix
+	case contractTypeRe.MatchString(typeString):
+		return "address" + suffix
+	case typeString == "address payable":
+		return "address" + suffix
+	default:
+		return typeString + suffix
+	}
+}
+
+func (*Tracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+	log.Printf("Fault: PC %d %s // %s", pc, op.String(), strings.ToLower(scope.Contract.Address().String()))
+	log.Printf("Error depth %d, %s", depth, err)
+}
+
+func (t *Tracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	//log.Printf("End: Output %x, Gas Used %d, Err %s", output, gasUsed, err)
+	if root := t.callStack.Peek(); root != nil {
+		root.Output = fmt.Sprintf("0x%x", output)
+		root.GasUsed = fmt.Sprintf("0x%x", gasUsed)
+		t.callStack.Pop()
+	}
+}
+
+// GetResult and Stop implement go-ethereum's tracers.Tracer interface so
+// *Tracer can be looked up and driven by name (see newSourceTracer) instead
+// of only via the standalone CLI in main.go.
+
+func (t *Tracer) GetResult() (json.RawMessage, error) {
+	return json.Marshal(t.ToCallTracer())
+}
+
+func (t *Tracer) Stop(err error) {
+	t.stopReason = err
+}
+
+// newSourceTracer constructs a Tracer for registration under the name
+// "sourceTracer", so it can be selected via
+// debug_traceTransaction(hash, {tracer: "sourceTracer"}) on a running geth
+// node instead of only via the standalone CLI in main.go.
+func newSourceTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	contracts, err := Contracts()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTracer(contracts), nil
+}
+
+func init() {
+	tracers.DefaultDirectory.Register("sourceTracer", newSourceTracer, false)
+}
+
+// ToCallTracer folds the flat, depth-annotated CallStack into the nested
+// call tree produced by go-ethereum's "callTracer" (the default shape behind
+// debug_traceTransaction), so a trace can be piped into block explorers and
+// other tooling built around that RPC. Internal (JUMP-based) and event (LOG)
+// frames are skipped since they aren't real EVM message calls.
+func (t *Tracer) ToCallTracer() *CallFrame {
+	var calls []*CallFrame
+	for _, frame := range t.Stack {
+		if frame.Type == "" || frame.Type == "INTERNAL" || frame.Type == "EVENT" {
+			continue
+		}
+
+		calls = append(calls, frame)
+	}
+
+	if len(calls) == 0 {
+		return nil
+	}
+
+	root := calls[0]
+	stack := []*CallFrame{root}
+	for _, frame := range calls[1:] {
+		for len(stack) > 1 && stack[len(stack)-1].callDepth >= frame.callDepth {
+			stack = stack[:len(stack)-1]
+		}
+
+		parent := stack[len(stack)-1]
+		parent.Calls = append(parent.Calls, frame)
+		stack = append(stack, frame)
+	}
+
+	return root
+}
+
+// GasReport returns the trace's gas hotspots: the source lines that cost the
+// most gas overall (across however many times they executed), sorted
+// descending, plus a per-opcode breakdown for a coarser view of where gas
+// went.
+func (t *Tracer) GasReport() ([]*LineGas, map[string]uint64) {
+	lines := make([]*LineGas, 0, len(t.gasByLine))
+	for _, line := range t.gasByLine {
+		lines = append(lines, line)
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].Gas > lines[j].Gas
+	})
+
+	byOp := make(map[string]uint64, len(t.gasByOp))
+	for op, gas := range t.gasByOp {
+		byOp[op.String()] = gas
+	}
+
+	return lines, byOp
+}
+
 func (t *Tracer) toInstruction(contract *vm.Contract, pc uint64) uint64 {
 	pcToI, ok := t.instructionMaps[strings.ToLower(contract.Address().String())]
 	if !ok {
@@ -339,20 +806,10 @@ func (t *Tracer) toSource(contract *vm.Contract, pc uint64) string {
 	i := t.toInstruction(contract, pc)
 
 	mapping := t.toSourceMapping(contract, i)
-
-	truffleContract, ok := t.contracts[strings.ToLower(contract.Address().String())]
-	if !ok {
+	if mapping == nil {
 		return "N/A"
 	}
 
-	return truffleContract.SourceCode[mapping.Start : mapping.Start+mapping.Length]
-}
-
-func (t *Tracer) toPreviousSource(contract *vm.Contract, pc uint64) string {
-	i := t.toInstruction(contract, pc)
-
-	mapping := t.toPreviousSourceMapping(contract, i)
-
 	truffleContract, ok := t.contracts[strings.ToLower(contract.Address().String())]
 	if !ok {
 		return "N/A"
@@ -374,25 +831,6 @@ func (t *Tracer) toSourceMapping(contract *vm.Contract, instruction uint64) *Sou
 	return srcMap[instruction]
 }
 
-func (t *Tracer) toPreviousSourceMapping(contract *vm.Contract, instruction uint64) *SourceMapping {
-	srcMap, ok := t.sourceMaps[strings.ToLower(contract.Address().String())]
-	if !ok {
-		return nil
-	}
-
-	if int(instruction) >= len(srcMap) {
-		return nil
-	}
-
-	next := srcMap[instruction]
-	realInstruction := instruction - 1
-	for next.Start == srcMap[realInstruction].Start && next.Length == srcMap[realInstruction].Length {
-		realInstruction--
-	}
-
-	return srcMap[realInstruction]
-}
-
 func (t *Tracer) isFunctionDefinition(contract *vm.Contract, mapping *SourceMapping) *AstNode {
 	fnDefs, ok := t.functionDefs[strings.ToLower(contract.Address().String())]
 	if !ok {
@@ -415,6 +853,10 @@ func (t *Tracer) findFnDef(addr string, receiver []byte) *AstNode {
 		return nil
 	}
 
+	if len(receiver) < 4 {
+		return nil
+	}
+
 	fnDefs := DiscoverFunctionDefinitions(contract.Ast)
 
 	target := fmt.Sprintf("%x", receiver[:4])
@@ -430,34 +872,243 @@ func (t *Tracer) findFnDef(addr string, receiver []byte) *AstNode {
 	return nil
 }
 
-func DecodeParam(node *AstNode, offset int, input []byte) (string, int) {
-	name := node.TypeDescriptions.TypeString
-	if strings.HasPrefix(name, "int") ||
-		strings.HasPrefix(name, "uint") {
-		val := big.NewInt(0)
-		val.SetBytes(input[offset : offset+32])
+// DiscoverConstructorDefinition returns the contract's constructor
+// FunctionDefinition node, or nil if it has no explicit constructor (solc
+// synthesizes a parameterless one in that case, so there's nothing to decode).
+func DiscoverConstructorDefinition(ast *AstNode) *AstNode {
+	for _, node := range ast.Nodes {
+		if node.NodeType == "FunctionDefinition" && node.Kind == "constructor" {
+			return node
+		}
+	}
 
-		return node.Name + " = " + val.String(), 32
+	return nil
+}
+
+// DiscoverEventDefinitions returns a contract's EventDefinition nodes,
+// analogous to DiscoverFunctionDefinitions.
+func DiscoverEventDefinitions(ast *AstNode) []*AstNode {
+	var events []*AstNode
+	for _, node := range ast.Nodes {
+		if node.NodeType == "EventDefinition" {
+			events = append(events, node)
+		}
 	}
 
-	if name == "address" {
-		val := input[offset : offset+32]
+	return events
+}
 
-		return node.Name + " = " + common.BytesToAddress(val).String(), 32
+// DiscoverErrorDefinitions returns a contract's ErrorDefinition nodes
+// (Solidity custom errors), analogous to DiscoverEventDefinitions.
+func DiscoverErrorDefinitions(ast *AstNode) []*AstNode {
+	var errors []*AstNode
+	for _, node := range ast.Nodes {
+		if node.NodeType == "ErrorDefinition" {
+			errors = append(errors, node)
+		}
 	}
 
-	if name == "bool" {
-		val := big.NewInt(0)
-		val.SetBytes(input[offset : offset+32])
+	return errors
+}
 
-		if val.Cmp(big.NewInt(0)) > 0 {
-			return node.Name + " = true", 32
-		} else {
-			return node.Name + " = false", 32
+var (
+	enumTypeRe     = regexp.MustCompile(`^enum [\w.]+`)
+	contractTypeRe = regexp.MustCompile(`^contract\b`)
+	structTypeRe   = regexp.MustCompile(`^struct [\w.]+`)
+	arraySuffixRe  = regexp.MustCompile(`(\[\d*\])+$`)
+)
+
+// DecodeParams ABI-decodes a full parameter list out of data (calldata past
+// the selector, or constructor args past the deployment bytecode) using
+// go-ethereum's accounts/abi package, which understands the head/tail layout
+// dynamic types need (a 32-byte offset in the head, with the actual data at
+// that offset from the start of the args region) instead of the previous
+// always-32-bytes-per-param assumption. A parameter whose type this AST
+// wrapper can't resolve (struct/tuple, which would need component metadata
+// it doesn't expose) is substituted with an opaque bytes32 placeholder so it
+// still occupies its single head slot and every other parameter decodes
+// normally, instead of one unsupported param blanking out the whole list;
+// that parameter renders as "<typeString>" rather than its value.
+func DecodeParams(params []*AstNode, data []byte) []string {
+	rendered := decodeParamValues(params, data)
+
+	var decoded []string
+	for _, r := range rendered {
+		if r == "" {
+			continue
+		}
+
+		decoded = append(decoded, r)
+	}
+
+	return decoded
+}
+
+// decodeParamValues is DecodeParams' core: it returns one rendered
+// "name = value" string per entry in params, aligned 1:1 by index (an
+// unnamed parameter renders as "" rather than being dropped), so callers
+// that need to interleave the result with other positional data (see
+// DecodeEventArgs) can still tell which original parameter each entry
+// came from. On an unpacking failure every entry is "".
+func decodeParamValues(params []*AstNode, data []byte) []string {
+	args := make(abi.Arguments, len(params))
+	opaque := make([]bool, len(params))
+	for i, param := range params {
+		typ, err := abiType(param)
+		if err != nil {
+			log.Printf("Cannot ABI-decode %q, rendering as opaque: %s", param.TypeDescriptions.TypeString, err)
+
+			typ, _ = abi.NewType("bytes32", "", nil)
+			opaque[i] = true
+		}
+
+		args[i] = abi.Argument{Name: param.Name, Type: typ}
+	}
+
+	rendered := make([]string, len(params))
+
+	values, err := args.UnpackValues(data)
+	if err != nil {
+		log.Printf("Failed unpacking ABI params: %s", err)
+		return rendered
+	}
+
+	for i, value := range values {
+		if params[i].Name == "" {
+			continue
+		}
+
+		v := formatABIValue(value)
+		if opaque[i] {
+			v = "<" + params[i].TypeDescriptions.TypeString + ">"
+		}
+
+		rendered[i] = params[i].Name + " = " + v
+	}
+
+	return rendered
+}
+
+// abiType translates a solc typeString (e.g. "uint256[3]", "enum Foo.Color",
+// "contract IERC20", "bytes", "string") into the go-ethereum abi.Type it
+// corresponds to. Structs are rejected since decoding their member layout
+// needs component metadata this AST wrapper doesn't expose.
+func abiType(node *AstNode) (abi.Type, error) {
+	typeString := node.TypeDescriptions.TypeString
+
+	suffix, base := "", typeString
+	if loc := arraySuffixRe.FindStringIndex(typeString); loc != nil {
+		suffix, base = typeString[loc[0]:], typeString[:loc[0]]
+	}
+
+	switch {
+	case enumTypeRe.MatchString(base):
+		return abi.NewType("uint8"+suffix, "", nil)
+	case contractTypeRe.MatchString(base):
+		return abi.NewType("address"+suffix, "", nil)
+	case structTypeRe.MatchString(typeString):
+		return abi.Type{}, fmt.Errorf("struct/tuple params need component metadata")
+	default:
+		return abi.NewType(typeString, "", nil)
+	}
+}
+
+// DecodeEventArgs decodes a LOG's topics/data into "name = value" strings,
+// in declaration order: indexed params come from topics (topic0 is the event
+// signature, so topics here must already have it stripped), non-indexed
+// params are ABI-decoded from data the same way call/constructor params are.
+func DecodeEventArgs(eventDef *AstNode, topics []common.Hash, data []byte) []string {
+	var nonIndexed []*AstNode
+	for _, param := range eventDef.Parameters.Parameters {
+		if !param.Indexed {
+			nonIndexed = append(nonIndexed, param)
+		}
+	}
+
+	nonIndexedValues := decodeParamValues(nonIndexed, data)
+
+	var args []string
+	indexedN, nonIndexedN := 0, 0
+	for _, param := range eventDef.Parameters.Parameters {
+		if param.Indexed {
+			if indexedN < len(topics) {
+				args = append(args, param.Name+" = "+formatIndexedTopic(param, topics[indexedN]))
+			}
+			indexedN++
+			continue
+		}
+
+		if v := nonIndexedValues[nonIndexedN]; v != "" {
+			args = append(args, v)
 		}
+		nonIndexedN++
 	}
 
-	return "", 32
+	return args
+}
+
+// formatIndexedTopic decodes a single indexed event argument out of its
+// topic word. Dynamic types (string, bytes, arrays, structs) are indexed as
+// the keccak256 hash of their value rather than the value itself, so those
+// just render as the raw topic.
+func formatIndexedTopic(node *AstNode, topic common.Hash) string {
+	typ, err := abiType(node)
+	if err != nil || isDynamicABIType(typ) || typ.T == abi.ArrayTy {
+		return topic.String()
+	}
+
+	values, err := (abi.Arguments{{Type: typ}}).UnpackValues(topic.Bytes())
+	if err != nil {
+		return topic.String()
+	}
+
+	return formatABIValue(values[0])
+}
+
+func isDynamicABIType(typ abi.Type) bool {
+	switch typ.T {
+	case abi.StringTy, abi.BytesTy, abi.SliceTy:
+		return true
+	case abi.ArrayTy:
+		return isDynamicABIType(*typ.Elem)
+	default:
+		return false
+	}
+}
+
+// formatABIValue renders a value decoded by abi.Arguments.UnpackValues the
+// same way the legacy "name = value" frames did: hex for bytes, decimal for
+// numbers, and a bracketed list for arrays/slices.
+func formatABIValue(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return fmt.Sprintf("0x%x", v)
+	case common.Address:
+		return v.String()
+	case *big.Int:
+		return v.String()
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return fmt.Sprintf("0x%x", b)
+		}
+
+		fallthrough
+	case reflect.Slice:
+		parts := make([]string, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			parts[i] = formatABIValue(rv.Index(i).Interface())
+		}
+
+		return "[" + strings.Join(parts, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", value)
+	}
 }
 
 func DecodeStack(node *AstNode, item *big.Int) string {
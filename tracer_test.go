@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestToCallTracerNestsByCallDepthNotJumpDepth(t *testing.T) {
+	root := &CallFrame{Contract: "0xroot", Type: "CALL", callDepth: 0}
+	child := &CallFrame{Contract: "0xchild", Type: "CALL", callDepth: 1}
+	// Depth (which also counts internal JUMPs) is inflated way past callDepth
+	// here; the tree must still nest by callDepth alone.
+	grandchild := &CallFrame{Contract: "0xgrandchild", Type: "CALL", callDepth: 2, Depth: 50}
+
+	tr := &Tracer{Stack: CallStack{root, child, grandchild}}
+
+	got := tr.ToCallTracer()
+	if got != root {
+		t.Fatalf("ToCallTracer() root = %v, want %v", got, root)
+	}
+	if len(root.Calls) != 1 || root.Calls[0] != child {
+		t.Fatalf("root.Calls = %v, want [child]", root.Calls)
+	}
+	if len(child.Calls) != 1 || child.Calls[0] != grandchild {
+		t.Fatalf("child.Calls = %v, want [grandchild]", child.Calls)
+	}
+}
+
+func TestToCallTracerSkipsInternalAndEventFrames(t *testing.T) {
+	root := &CallFrame{Contract: "0xroot", Type: "CALL", callDepth: 0}
+	internal := &CallFrame{Contract: "0xroot", Type: "INTERNAL", Depth: 5}
+	event := &CallFrame{Contract: "0xroot", Type: "EVENT", Depth: 5}
+
+	tr := &Tracer{Stack: CallStack{root, internal, event}}
+
+	got := tr.ToCallTracer()
+	if got != root || len(root.Calls) != 0 {
+		t.Fatalf("ToCallTracer() = %+v, want a childless root", got)
+	}
+}
+
+func TestDecodeParamsStaticAndDynamicTypes(t *testing.T) {
+	addressTy, _ := abi.NewType("address", "", nil)
+	arrayTy, _ := abi.NewType("uint256[]", "", nil)
+
+	to := common.HexToAddress("0x0000000000000000000000000000000000001234")
+	data, err := (abi.Arguments{{Type: addressTy}, {Type: arrayTy}}).
+		Pack(to, []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)})
+	if err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+
+	toParam := &AstNode{Name: "to"}
+	toParam.TypeDescriptions.TypeString = "address"
+	idsParam := &AstNode{Name: "ids"}
+	idsParam.TypeDescriptions.TypeString = "uint256[]"
+
+	got := DecodeParams([]*AstNode{toParam, idsParam}, data)
+	want := []string{"to = " + to.String(), "ids = [1, 2, 3]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DecodeParams() = %v, want %v", got, want)
+	}
+}
+
+func TestEventSignatureCanonicalizesTypes(t *testing.T) {
+	fromParam := &AstNode{Name: "from"}
+	fromParam.TypeDescriptions.TypeString = "address payable"
+	idsParam := &AstNode{Name: "ids"}
+	idsParam.TypeDescriptions.TypeString = "enum Foo.Bar[]"
+
+	eventDef := &AstNode{Name: "Transfer"}
+	eventDef.Parameters.Parameters = []*AstNode{fromParam, idsParam}
+
+	got := eventSignature(eventDef)
+	want := "Transfer(address,uint8[])"
+	if got != want {
+		t.Fatalf("eventSignature() = %q, want %q", got, want)
+	}
+}
+
+func TestDecodeEventArgsIndexedAndNonIndexed(t *testing.T) {
+	fromParam := &AstNode{Name: "from", Indexed: true}
+	fromParam.TypeDescriptions.TypeString = "address"
+	valueParam := &AstNode{Name: "value"}
+	valueParam.TypeDescriptions.TypeString = "uint256"
+
+	eventDef := &AstNode{Name: "Transfer"}
+	eventDef.Parameters.Parameters = []*AstNode{fromParam, valueParam}
+
+	from := common.HexToAddress("0x0000000000000000000000000000000000001234")
+	topic := common.BytesToHash(common.LeftPadBytes(from.Bytes(), 32))
+
+	valueTy, _ := abi.NewType("uint256", "", nil)
+	data, err := (abi.Arguments{{Type: valueTy}}).Pack(big.NewInt(42))
+	if err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+
+	got := DecodeEventArgs(eventDef, []common.Hash{topic}, data)
+	want := []string{"from = " + from.String(), "value = 42"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DecodeEventArgs() = %v, want %v", got, want)
+	}
+}
+
+func TestDecodeRevertStandardError(t *testing.T) {
+	stringTy, _ := abi.NewType("string", "", nil)
+	payload, err := (abi.Arguments{{Type: stringTy}}).Pack("insufficient balance")
+	if err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	data := append(append([]byte{}, revertStringSelector...), payload...)
+
+	tr := &Tracer{}
+	reason, args := tr.decodeRevert("0xcontract", data)
+	if reason != "insufficient balance" || args != nil {
+		t.Fatalf("decodeRevert() = (%q, %v), want (%q, nil)", reason, args, "insufficient balance")
+	}
+}
+
+func TestDecodeRevertCustomError(t *testing.T) {
+	amountParam := &AstNode{Name: "available"}
+	amountParam.TypeDescriptions.TypeString = "uint256"
+
+	errDef := &AstNode{Name: "InsufficientBalance"}
+	errDef.Parameters.Parameters = []*AstNode{amountParam}
+
+	const addr = "0xcontract"
+	tr := &Tracer{errorDefs: map[string][]*AstNode{addr: {errDef}}}
+
+	amountTy, _ := abi.NewType("uint256", "", nil)
+	payload, err := (abi.Arguments{{Type: amountTy}}).Pack(big.NewInt(5))
+	if err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	selector := crypto.Keccak256([]byte(errorSignature(errDef)))[:4]
+	data := append(append([]byte{}, selector...), payload...)
+
+	reason, args := tr.decodeRevert(addr, data)
+	wantReason := "InsufficientBalance(available = 5)"
+	wantArgs := []string{"available = 5"}
+	if reason != wantReason || !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("decodeRevert() = (%q, %v), want (%q, %v)", reason, args, wantReason, wantArgs)
+	}
+}